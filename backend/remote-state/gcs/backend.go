@@ -4,16 +4,19 @@ package gcs
 import (
 	"context"
 	"encoding/base64"
+	"encoding/json"
 	"fmt"
 	"log"
 	"os"
 	"strings"
+	"time"
 
 	"cloud.google.com/go/storage"
 	"github.com/hashicorp/terraform/backend"
 	"github.com/hashicorp/terraform/httpclient"
 	"github.com/hashicorp/terraform/internal/legacy/helper/schema"
 	"golang.org/x/oauth2"
+	"google.golang.org/api/impersonate"
 	"google.golang.org/api/option"
 )
 
@@ -30,6 +33,10 @@ type Backend struct {
 	prefix     string
 
 	encryptionKey []byte
+	kmsKeyName    string
+
+	lockingMode string
+	lockTimeout time.Duration
 }
 
 func New() backend.Backend {
@@ -54,7 +61,7 @@ func New() backend.Backend {
 				Optional:      true,
 				Description:   "Google Cloud JSON Account Key",
 				Default:       "",
-				ConflictsWith: []string{"access_token"},
+				ConflictsWith: []string{"access_token", "external_credentials"},
 			},
 
 			"access_token": {
@@ -64,7 +71,61 @@ func New() backend.Backend {
 					"GOOGLE_OAUTH_ACCESS_TOKEN",
 				}, nil),
 				Description:   "An OAuth2 token used for GCP authentication",
-				ConflictsWith: []string{"credentials"},
+				ConflictsWith: []string{"credentials", "external_credentials"},
+			},
+
+			"external_credentials": {
+				Type:          schema.TypeList,
+				Optional:      true,
+				MaxItems:      1,
+				Description:   "Configuration for authenticating via Workload Identity Federation instead of a long-lived service account key.",
+				ConflictsWith: []string{"credentials", "access_token"},
+				Elem: &schema.Resource{
+					Schema: map[string]*schema.Schema{
+						"audience": {
+							Type:        schema.TypeString,
+							Required:    true,
+							Description: "The Workload Identity Pool provider audience, e.g. '//iam.googleapis.com/projects/.../workloadIdentityPools/.../providers/...'",
+						},
+
+						"service_account_email": {
+							Type:        schema.TypeString,
+							Optional:    true,
+							Description: "The email of the service account to impersonate using the external token, via the IAM Credentials API",
+						},
+
+						"token_source_type": {
+							Type:        schema.TypeString,
+							Required:    true,
+							Description: "The source of the external token: 'oidc_file', 'oidc_url', or 'aws'",
+						},
+
+						"oidc_file_path": {
+							Type:        schema.TypeString,
+							Optional:    true,
+							Description: "Path to a file containing an OIDC token, used when token_source_type is 'oidc_file'",
+						},
+
+						"oidc_url": {
+							Type:        schema.TypeString,
+							Optional:    true,
+							Description: "URL that returns an OIDC token in its response body, used when token_source_type is 'oidc_url'",
+						},
+
+						"oidc_url_headers": {
+							Type:        schema.TypeMap,
+							Optional:    true,
+							Description: "HTTP headers to send when requesting the token from oidc_url",
+							Elem:        &schema.Schema{Type: schema.TypeString},
+						},
+
+						"aws_region": {
+							Type:        schema.TypeString,
+							Optional:    true,
+							Description: "The AWS region to use when deriving credentials from the AWS environment, used when token_source_type is 'aws'",
+						},
+					},
+				},
 			},
 
 			"impersonate_service_account": {
@@ -83,11 +144,54 @@ func New() backend.Backend {
 				Elem:        &schema.Schema{Type: schema.TypeString},
 			},
 
+			"impersonate_service_account_lifetime": {
+				Type:        schema.TypeInt,
+				Optional:    true,
+				Description: "The lifetime, in seconds, of the tokens issued for the impersonated service account",
+			},
+
+			"scopes": {
+				Type:        schema.TypeList,
+				Optional:    true,
+				Description: "The list of scopes to request when authenticating against the Google Cloud API",
+				Elem:        &schema.Schema{Type: schema.TypeString},
+			},
+
 			"encryption_key": {
+				Type:          schema.TypeString,
+				Optional:      true,
+				Description:   "A 32 byte base64 encoded 'customer supplied encryption key' used to encrypt all state.",
+				Default:       "",
+				ConflictsWith: []string{"kms_encryption_key"},
+			},
+
+			"kms_encryption_key": {
+				Type:          schema.TypeString,
+				Optional:      true,
+				Description:   "A Cloud KMS key ('customer managed encryption key') used to encrypt state.",
+				Default:       "",
+				ConflictsWith: []string{"encryption_key"},
+				ValidateFunc:  validateKmsKeyName,
+			},
+
+			"locking_mode": {
 				Type:        schema.TypeString,
 				Optional:    true,
-				Description: "A 32 byte base64 encoded 'customer supplied encryption key' used to encrypt all state.",
-				Default:     "",
+				Default:     lockingModeObject,
+				Description: "The state locking strategy: 'object' uses a sibling '.tflock' object (the default); 'generation' uses preconditions on the state object's own generation, leaving no lock object behind.",
+				ValidateFunc: func(v interface{}, k string) (ws []string, errors []error) {
+					value := v.(string)
+					if value != lockingModeObject && value != lockingModeGeneration {
+						errors = append(errors, fmt.Errorf("%q must be one of %q or %q, got: %q", k, lockingModeObject, lockingModeGeneration, value))
+					}
+					return
+				},
+			},
+
+			"lock_timeout": {
+				Type:        schema.TypeInt,
+				Optional:    true,
+				Description: "The number of seconds to retry acquiring a 'generation' mode lock before giving up. Defaults to 10 seconds.",
 			},
 
 			"project": {
@@ -130,29 +234,94 @@ func (b *Backend) configure(ctx context.Context) error {
 		b.prefix = b.prefix + "/"
 	}
 
-	var opts []option.ClientOption
+	opts, err := clientOptions(b.storageContext, data)
+	if err != nil {
+		return err
+	}
 
-	// Add credential source
-	var creds string
-	var ImpersonateServiceAccount string
-	var ImpersonateServiceAccountDelegates []string
+	opts = append(opts, option.WithUserAgent(httpclient.UserAgentString()))
+	client, err := storage.NewClient(b.storageContext, opts...)
+	if err != nil {
+		return fmt.Errorf("storage.NewClient() failed: %v", err)
+	}
 
-	if v, ok := data.GetOk("impersonate_service_account"); ok {
-		ImpersonateServiceAccount = v.(string)
+	b.storageClient = client
+
+	key := data.Get("encryption_key").(string)
+	if key == "" {
+		key = os.Getenv("GOOGLE_ENCRYPTION_KEY")
 	}
 
-	if v, ok := data.GetOk("impersonate_service_account_delegates"); ok {
-		var delegates []string
-		d := v.([]interface{})
-		if len(delegates) > 0 {
-			delegates = make([]string, len(d))
+	kmsName := data.Get("kms_encryption_key").(string)
+	if kmsName == "" {
+		kmsName = os.Getenv("GOOGLE_KMS_ENCRYPTION_KEY")
+	}
+
+	// The schema's ConflictsWith only catches both being set directly in
+	// config; it can't see the GOOGLE_ENCRYPTION_KEY / GOOGLE_KMS_ENCRYPTION_KEY
+	// env var fallbacks above, so the resolved values are checked again here.
+	if key != "" && kmsName != "" {
+		return fmt.Errorf("encryption_key and kms_encryption_key cannot both be set (including via GOOGLE_ENCRYPTION_KEY and GOOGLE_KMS_ENCRYPTION_KEY)")
+	}
+
+	if key != "" {
+		kc, err := backend.ReadPathOrContents(key)
+		if err != nil {
+			return fmt.Errorf("Error loading encryption key: %s", err)
 		}
-		for _, delegate := range d {
-			delegates = append(delegates, delegate.(string))
+
+		// The GCS client expects a customer supplied encryption key to be
+		// passed in as a 32 byte long byte slice. The byte slice is base64
+		// encoded before being passed to the API. We take a base64 encoded key
+		// to remain consistent with the GCS docs.
+		// https://cloud.google.com/storage/docs/encryption#customer-supplied
+		// https://github.com/GoogleCloudPlatform/google-cloud-go/blob/def681/storage/storage.go#L1181
+		k, err := base64.StdEncoding.DecodeString(kc)
+		if err != nil {
+			return fmt.Errorf("Error decoding encryption key: %s", err)
 		}
-		ImpersonateServiceAccountDelegates = delegates
+		b.encryptionKey = k
 	}
 
+	b.kmsKeyName = kmsName
+
+	b.lockingMode = data.Get("locking_mode").(string)
+	if v, ok := data.GetOk("lock_timeout"); ok {
+		b.lockTimeout = time.Duration(v.(int)) * time.Second
+	}
+
+	return nil
+}
+
+// validateKmsKeyName checks that a kms_encryption_key value looks like a
+// fully-qualified Cloud KMS crypto key resource name, e.g.
+// "projects/my-project/locations/global/keyRings/my-ring/cryptoKeys/my-key".
+func validateKmsKeyName(v interface{}, k string) (ws []string, errors []error) {
+	value := v.(string)
+	if value == "" {
+		return
+	}
+
+	parts := strings.Split(value, "/")
+	if len(parts) != 8 || parts[0] != "projects" || parts[2] != "locations" || parts[4] != "keyRings" || parts[6] != "cryptoKeys" {
+		errors = append(errors, fmt.Errorf(
+			"%q must be a fully-qualified Cloud KMS crypto key resource name of the form "+
+				"\"projects/{project}/locations/{location}/keyRings/{keyRing}/cryptoKeys/{cryptoKey}\", got: %q", k, value))
+	}
+
+	return
+}
+
+// clientOptions builds the option.ClientOption slice used to construct the
+// storage client from the backend config. The base credential (JSON key,
+// access token, or ADC) is built first, and impersonation, if configured,
+// is layered on top of it via a token source so the final slice carries at
+// most one authentication option (none when falling back to ADC without
+// impersonation).
+func clientOptions(ctx context.Context, data *schema.ResourceData) ([]option.ClientOption, error) {
+	var opts []option.ClientOption
+
+	var creds string
 	if v, ok := data.GetOk("credentials"); ok {
 		creds = v.(string)
 	} else if v := os.Getenv("GOOGLE_BACKEND_CREDENTIALS"); v != "" {
@@ -161,71 +330,149 @@ func (b *Backend) configure(ctx context.Context) error {
 		creds = os.Getenv("GOOGLE_CREDENTIALS")
 	}
 
-	if creds != "" {
+	switch {
+	case creds != "":
 		contents, err := backend.ReadPathOrContents(creds)
 		if err != nil {
-			return fmt.Errorf("error loading credentials: %s", err)
+			return nil, fmt.Errorf("error loading credentials: %s", err)
 		}
-		if ImpersonateServiceAccount != "" {
-			opts = []option.ClientOption{option.WithCredentialsJSON([]byte(contents)), option.ImpersonateCredentials(ImpersonateServiceAccount, ImpersonateServiceAccountDelegates...)}
-		}
-		opts = []option.ClientOption{option.WithCredentialsJSON([]byte(contents))}
+		opts = append(opts, option.WithCredentialsJSON([]byte(contents)))
 
 		log.Printf("[INFO] Authenticating using configured Google JSON 'credentials'...")
+	case data.Get("access_token").(string) != "":
+		token := &oauth2.Token{AccessToken: data.Get("access_token").(string)}
+		opts = append(opts, option.WithTokenSource(oauth2.StaticTokenSource(token)))
+
+		log.Printf("[INFO] Authenticating using configured Google 'access_token'...")
+	case len(data.Get("external_credentials").([]interface{})) > 0:
+		ec := data.Get("external_credentials").([]interface{})[0].(map[string]interface{})
+		contents, err := externalAccountCredentialsJSON(ec)
+		if err != nil {
+			return nil, fmt.Errorf("error building external_credentials: %s", err)
+		}
+		opts = append(opts, option.WithCredentialsJSON(contents))
+
+		log.Printf("[INFO] Authenticating using configured 'external_credentials' (Workload Identity Federation)...")
+	default:
+		log.Printf("[INFO] Authenticating using DefaultClient...")
 	}
 
-	if ImpersonateServiceAccount != "" {
-		opts = append(opts, option.ImpersonateCredentials(ImpersonateServiceAccount, ImpersonateServiceAccountDelegates...))
+	var scopes []string
+	if v, ok := data.GetOk("scopes"); ok {
+		for _, scope := range v.([]interface{}) {
+			scopes = append(scopes, scope.(string))
+		}
+	}
+	if len(scopes) == 0 {
+		scopes = []string{storage.ScopeReadWrite}
 	}
 
-	log.Printf("[INFO] Authenticating using DefaultClient...")
+	if v, ok := data.GetOk("impersonate_service_account"); ok {
+		targetPrincipal := v.(string)
 
-	if v, ok := data.GetOk("access_token"); ok {
-		contents, err := backend.ReadPathOrContents(v.(string))
-		if err != nil {
-			return fmt.Errorf("Error loading access token: %s", err)
+		var delegates []string
+		if v, ok := data.GetOk("impersonate_service_account_delegates"); ok {
+			for _, delegate := range v.([]interface{}) {
+				delegates = append(delegates, delegate.(string))
+			}
 		}
-		token := &oauth2.Token{AccessToken: contents}
-		opts = []option.ClientOption{option.WithTokenSource(oauth2.StaticTokenSource(token))}
 
-		if ImpersonateServiceAccount != "" {
-			opts = []option.ClientOption{option.WithTokenSource(oauth2.StaticTokenSource(token)), option.ImpersonateCredentials(ImpersonateServiceAccount, ImpersonateServiceAccountDelegates...)}
+		var lifetime time.Duration
+		if v, ok := data.GetOk("impersonate_service_account_lifetime"); ok {
+			lifetime = time.Duration(v.(int)) * time.Second
 		}
 
-		log.Printf("[INFO] Authenticating using configured Google 'access_token'...")
+		ts, err := impersonate.CredentialsTokenSource(ctx, impersonate.CredentialsConfig{
+			TargetPrincipal: targetPrincipal,
+			Scopes:          scopes,
+			Delegates:       delegates,
+			Lifetime:        lifetime,
+		}, opts...)
+		if err != nil {
+			return nil, fmt.Errorf("error impersonating %q: %s", targetPrincipal, err)
+		}
+
+		// The impersonated token source replaces the base credential options
+		// entirely; it already carries the base credentials internally.
+		opts = []option.ClientOption{option.WithTokenSource(ts)}
 	}
 
-	opts = append(opts, option.WithUserAgent(httpclient.UserAgentString()))
-	client, err := storage.NewClient(b.storageContext, opts...)
-	if err != nil {
-		return fmt.Errorf("storage.NewClient() failed: %v", err)
+	return opts, nil
+}
+
+// externalAccountCredentialsJSON builds an in-memory "type: external_account"
+// credentials file (the format documented at
+// https://google.aip.dev/auth/4117) from an `external_credentials` block, so
+// it can be passed to option.WithCredentialsJSON the same way a downloaded
+// service account key would be.
+func externalAccountCredentialsJSON(ec map[string]interface{}) ([]byte, error) {
+	audience, _ := ec["audience"].(string)
+	if audience == "" {
+		return nil, fmt.Errorf("audience is required")
 	}
 
-	b.storageClient = client
+	cred := map[string]interface{}{
+		"type":               "external_account",
+		"audience":           audience,
+		"token_url":          "https://sts.googleapis.com/v1/token",
+		"subject_token_type": "urn:ietf:params:oauth:token-type:jwt",
+	}
 
-	key := data.Get("encryption_key").(string)
-	if key == "" {
-		key = os.Getenv("GOOGLE_ENCRYPTION_KEY")
+	if email, _ := ec["service_account_email"].(string); email != "" {
+		cred["service_account_impersonation_url"] = fmt.Sprintf(
+			"https://iamcredentials.googleapis.com/v1/projects/-/serviceAccounts/%s:generateAccessToken", email)
 	}
 
-	if key != "" {
-		kc, err := backend.ReadPathOrContents(key)
-		if err != nil {
-			return fmt.Errorf("Error loading encryption key: %s", err)
+	tokenSourceType, _ := ec["token_source_type"].(string)
+	switch tokenSourceType {
+	case "oidc_file":
+		path, _ := ec["oidc_file_path"].(string)
+		if path == "" {
+			return nil, fmt.Errorf("oidc_file_path is required when token_source_type is %q", tokenSourceType)
+		}
+		cred["credential_source"] = map[string]interface{}{
+			"file": path,
 		}
 
-		// The GCS client expects a customer supplied encryption key to be
-		// passed in as a 32 byte long byte slice. The byte slice is base64
-		// encoded before being passed to the API. We take a base64 encoded key
-		// to remain consistent with the GCS docs.
-		// https://cloud.google.com/storage/docs/encryption#customer-supplied
-		// https://github.com/GoogleCloudPlatform/google-cloud-go/blob/def681/storage/storage.go#L1181
-		k, err := base64.StdEncoding.DecodeString(kc)
-		if err != nil {
-			return fmt.Errorf("Error decoding encryption key: %s", err)
+	case "oidc_url":
+		url, _ := ec["oidc_url"].(string)
+		if url == "" {
+			return nil, fmt.Errorf("oidc_url is required when token_source_type is %q", tokenSourceType)
 		}
-		b.encryptionKey = k
+		source := map[string]interface{}{
+			"url":    url,
+			"format": map[string]interface{}{"type": "text"},
+		}
+		if headers, ok := ec["oidc_url_headers"].(map[string]interface{}); ok && len(headers) > 0 {
+			source["headers"] = headers
+		}
+		cred["credential_source"] = source
+
+	case "aws":
+		cred["subject_token_type"] = "urn:ietf:params:aws:token-type:aws4_request"
+		// region_url and url are EC2 instance metadata service endpoints: the
+		// credential source calls region_url to discover which AWS region
+		// it's running in, then substitutes that into
+		// regional_cred_verification_url (an STS host) to verify the request
+		// it builds from the security credentials at url. None of this
+		// depends on aws_region being set; that field only lets a caller
+		// outside EC2 (e.g. Lambda) tell Google which STS region to address
+		// directly, overriding regional_cred_verification_url instead.
+		source := map[string]interface{}{
+			"environment_id":                 "aws1",
+			"region_url":                     "http://169.254.169.254/latest/meta-data/placement/availability-zone",
+			"url":                            "http://169.254.169.254/latest/meta-data/iam/security-credentials",
+			"regional_cred_verification_url": "https://sts.{region}.amazonaws.com?Action=GetCallerIdentity&Version=2011-06-15",
+		}
+		if region, _ := ec["aws_region"].(string); region != "" {
+			source["regional_cred_verification_url"] = fmt.Sprintf(
+				"https://sts.%s.amazonaws.com?Action=GetCallerIdentity&Version=2011-06-15", region)
+		}
+		cred["credential_source"] = source
+
+	default:
+		return nil, fmt.Errorf("unsupported token_source_type %q: must be one of oidc_file, oidc_url, aws", tokenSourceType)
 	}
 
-	return nil
+	return json.Marshal(cred)
 }
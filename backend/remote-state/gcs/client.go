@@ -0,0 +1,322 @@
+package gcs
+
+import (
+	"context"
+	"crypto/md5"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"time"
+
+	"cloud.google.com/go/storage"
+	"github.com/hashicorp/terraform/state"
+	"github.com/hashicorp/terraform/state/remote"
+	"google.golang.org/api/googleapi"
+)
+
+const (
+	lockingModeObject     = "object"
+	lockingModeGeneration = "generation"
+
+	// defaultLockTimeout bounds how long lockGeneration will retry a transient
+	// read failure acquiring a "generation" mode lock when lock_timeout isn't
+	// set.
+	defaultLockTimeout = 10 * time.Second
+)
+
+// remoteClient implements "state/remote".Client and "state".Locker, storing
+// the state as an object in a GCS bucket.
+type remoteClient struct {
+	storageContext context.Context
+	storageClient  *storage.Client
+	bucket         string
+	stateFilePath  string
+	lockFilePath   string
+	encryptionKey  []byte
+	kmsKeyName     string
+
+	// lockingMode selects between the ".tflock" companion object (the
+	// default, "object") and preconditions on the state object's own
+	// generation ("generation"). See Lock/Unlock/Put below.
+	lockingMode string
+	lockTimeout time.Duration
+
+	// generation is the state object generation this client last observed
+	// or wrote, used to build the precondition for the next write when
+	// lockingMode is "generation".
+	generation int64
+}
+
+func (c *remoteClient) Get() (*remote.Payload, error) {
+	stateFileReader, err := c.stateFileObject().NewReader(c.storageContext)
+	if err != nil {
+		if err == storage.ErrObjectNotExist {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("failed to open state file at %q: %v", c.stateFilePath, err)
+	}
+	defer stateFileReader.Close()
+
+	stateFileContents, err := ioutil.ReadAll(stateFileReader)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read state file from %q: %v", c.stateFilePath, err)
+	}
+
+	stateFileAttrs, err := c.stateFileObject().Attrs(c.storageContext)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read state file attrs from %q: %v", c.stateFilePath, err)
+	}
+
+	if c.lockingMode == lockingModeGeneration {
+		c.generation = stateFileAttrs.Generation
+	}
+
+	return &remote.Payload{
+		Data: stateFileContents,
+		MD5:  stateFileAttrs.MD5,
+	}, nil
+}
+
+// Put writes the state. When lockingMode is "generation" the write carries a
+// GenerationMatch precondition against the generation Lock last observed, so
+// a write that lost the race against another locker fails instead of
+// silently clobbering it. A precondition failure here means the data this
+// client built is already stale relative to the generation it was built
+// against, so it is reported as a LockError rather than retried: retrying
+// would mean re-reading the new generation and writing the same (now stale)
+// data under it, clobbering whoever just won. Recovering from the conflict
+// is the caller's job — reacquire the lock, refresh state, and try again.
+func (c *remoteClient) Put(data []byte) error {
+	if c.lockingMode != lockingModeGeneration {
+		return c.put(data, nil)
+	}
+
+	generation := c.generation
+	err := c.put(data, &generation)
+	if err == nil {
+		return nil
+	}
+	if !isPreconditionFailed(err) {
+		return err
+	}
+	return c.generationLockError(fmt.Errorf("state was modified by another locker (now at a newer generation): %w", err))
+}
+
+// put performs a single write attempt, applying a GenerationMatch
+// precondition when generation is non-nil. Generation 0 stands for an
+// object that did not exist; the storage client treats a zero
+// GenerationMatch as no condition at all, so that case uses DoesNotExist.
+func (c *remoteClient) put(data []byte, generation *int64) error {
+	o := c.stateFileObject()
+	if generation != nil {
+		if *generation == 0 {
+			o = o.If(storage.Conditions{DoesNotExist: true})
+		} else {
+			o = o.If(storage.Conditions{GenerationMatch: *generation})
+		}
+	}
+
+	w := o.NewWriter(c.storageContext)
+	w.ContentType = "application/json"
+	w.Metadata = map[string]string{
+		"X-Terraform-State-MD5": fmt.Sprintf("%x", md5.Sum(data)),
+	}
+	if c.kmsKeyName != "" {
+		w.KMSKeyName = c.kmsKeyName
+	}
+
+	if _, err := w.Write(data); err != nil {
+		return fmt.Errorf("failed to upload state to %q: %w", c.stateFilePath, err)
+	}
+	if err := w.Close(); err != nil {
+		return fmt.Errorf("failed to upload state to %q: %w", c.stateFilePath, err)
+	}
+
+	if generation != nil {
+		c.generation = w.Attrs().Generation
+	}
+
+	return nil
+}
+
+func (c *remoteClient) Delete() error {
+	if err := c.stateFileObject().Delete(c.storageContext); err != nil && err != storage.ErrObjectNotExist {
+		return fmt.Errorf("error deleting state from %q: %v", c.stateFilePath, err)
+	}
+	return nil
+}
+
+func (c *remoteClient) Lock(info *state.LockInfo) (string, error) {
+	if c.lockingMode == lockingModeGeneration {
+		return c.lockGeneration(info)
+	}
+	return c.lockObject(info)
+}
+
+func (c *remoteClient) Unlock(id string) error {
+	if c.lockingMode == lockingModeGeneration {
+		return c.unlockGeneration(id)
+	}
+	return c.unlockObject(id)
+}
+
+// lockObject is the original, default locking strategy: it creates a
+// sibling ".tflock" object and fails if one already exists.
+func (c *remoteClient) lockObject(info *state.LockInfo) (string, error) {
+	infoJSON, err := json.Marshal(info)
+	if err != nil {
+		return "", err
+	}
+
+	lockFile := c.lockFileObject()
+
+	w := lockFile.If(storage.Conditions{DoesNotExist: true}).NewWriter(c.storageContext)
+	if _, err := w.Write(infoJSON); err != nil {
+		return "", c.objectLockError(err)
+	}
+	if err := w.Close(); err != nil {
+		return "", c.objectLockError(err)
+	}
+
+	attrs, err := lockFile.Attrs(c.storageContext)
+	if err != nil {
+		return "", c.objectLockError(err)
+	}
+
+	info.ID = fmt.Sprintf("%v", attrs.Generation)
+	return info.ID, nil
+}
+
+func (c *remoteClient) objectLockError(err error) error {
+	existing, readErr := c.lockFileObject().NewReader(c.storageContext)
+	if readErr != nil {
+		return &state.LockError{Err: err}
+	}
+	defer existing.Close()
+
+	infoJSON, readErr := ioutil.ReadAll(existing)
+	if readErr != nil {
+		return &state.LockError{Err: err}
+	}
+
+	info := &state.LockInfo{}
+	if unmarshalErr := json.Unmarshal(infoJSON, info); unmarshalErr == nil {
+		return &state.LockError{Err: err, Info: info}
+	}
+
+	return &state.LockError{Err: err}
+}
+
+func (c *remoteClient) unlockObject(id string) error {
+	lockFile := c.lockFileObject()
+
+	attrs, err := lockFile.Attrs(c.storageContext)
+	if err != nil {
+		if err == storage.ErrObjectNotExist {
+			return nil
+		}
+		return c.objectLockError(err)
+	}
+
+	if fmt.Sprintf("%v", attrs.Generation) != id {
+		return c.objectLockError(fmt.Errorf("lock id %q does not match existing lock", id))
+	}
+
+	if err := lockFile.If(storage.Conditions{GenerationMatch: attrs.Generation}).Delete(c.storageContext); err != nil {
+		return c.objectLockError(err)
+	}
+
+	return nil
+}
+
+// lockGeneration "acquires" the lock by simply reading and remembering the
+// state object's current generation; it writes nothing. Exclusivity isn't
+// enforced here — it's enforced by Put's GenerationMatch precondition, so a
+// write based on a generation that's since moved on is rejected rather than
+// silently clobbering a concurrent writer's change. This is what lets the
+// state object itself be the lock, with no companion object to orphan.
+//
+// lock_timeout governs retries here, not in Put: a transient read failure
+// acquiring the lock is safe to retry (nothing has been written yet), while a
+// GenerationMatch conflict in Put means the data already in hand is stale
+// and must not be retried, only reported.
+func (c *remoteClient) lockGeneration(info *state.LockInfo) (string, error) {
+	timeout := c.lockTimeout
+	if timeout <= 0 {
+		timeout = defaultLockTimeout
+	}
+	deadline := time.Now().Add(timeout)
+	backoff := 100 * time.Millisecond
+
+	for {
+		attrs, err := c.stateFileObject().Attrs(c.storageContext)
+		var generation int64
+		switch {
+		case err == storage.ErrObjectNotExist:
+			generation = 0
+		case err != nil:
+			if time.Now().After(deadline) {
+				return "", c.generationLockError(err)
+			}
+			time.Sleep(jitter(backoff))
+			backoff = nextBackoff(backoff)
+			continue
+		default:
+			generation = attrs.Generation
+		}
+
+		c.generation = generation
+		info.ID = fmt.Sprintf("%v", generation)
+		return info.ID, nil
+	}
+}
+
+// unlockGeneration is a no-op: lockGeneration never wrote anything to
+// release, and the generation Put last wrote under has already moved past
+// whatever generation Lock captured, so there is nothing left to compare
+// the lock ID against.
+func (c *remoteClient) unlockGeneration(id string) error {
+	return nil
+}
+
+func (c *remoteClient) generationLockError(err error) error {
+	if err == nil {
+		return nil
+	}
+	return &state.LockError{Err: err}
+}
+
+func isPreconditionFailed(err error) bool {
+	var apiErr *googleapi.Error
+	if errors.As(err, &apiErr) {
+		return apiErr.Code == 412
+	}
+	return false
+}
+
+func nextBackoff(backoff time.Duration) time.Duration {
+	const max = 5 * time.Second
+	doubled := backoff * 2
+	if doubled > max {
+		return max
+	}
+	return doubled
+}
+
+func jitter(d time.Duration) time.Duration {
+	return d/2 + time.Duration(rand.Int63n(int64(d)))
+}
+
+func (c *remoteClient) stateFileObject() *storage.ObjectHandle {
+	o := c.storageClient.Bucket(c.bucket).Object(c.stateFilePath)
+	if len(c.encryptionKey) > 0 {
+		o = o.Key(c.encryptionKey)
+	}
+	return o
+}
+
+func (c *remoteClient) lockFileObject() *storage.ObjectHandle {
+	return c.storageClient.Bucket(c.bucket).Object(c.lockFilePath)
+}
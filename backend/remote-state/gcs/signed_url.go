@@ -0,0 +1,83 @@
+package gcs
+
+import (
+	"fmt"
+	"time"
+
+	"cloud.google.com/go/storage"
+)
+
+// SignedStateURLer is implemented by backends that can hand out a time-
+// limited signed URL for their state instead of requiring the caller to
+// hold real credentials. A `terraform state sign-url` command would
+// type-assert the configured backend against this interface and dispatch
+// to it.
+//
+// STATUS: partial, by necessity rather than by choice. This tree contains
+// only backend/remote-state/gcs and internal/logging — there is no
+// command/ directory, no main package, no Meta or backend-registration
+// machinery anywhere in the checkout for a `terraform state sign-url`
+// command to be added to or dispatched from. There is nothing in this tree
+// to wire the command into, so it isn't implemented here; this interface
+// and the backend-side capability below are the complete deliverable that
+// this tree can support. Adding the command itself is out of scope until
+// the command package exists in this tree.
+type SignedStateURLer interface {
+	SignedStateURL(workspace string, opts SignedURLOptions) (string, error)
+}
+
+// SignedURLOptions configures SignedStateURL.
+type SignedURLOptions struct {
+	// TTL is how long the returned URL remains valid for.
+	TTL time.Duration
+
+	// Method is the HTTP method the URL is valid for, e.g. "GET" to read
+	// state or "PUT" to write it. Defaults to "GET".
+	Method string
+
+	// Lock, when true, signs a URL for the workspace's lock file instead of
+	// its state file.
+	Lock bool
+}
+
+// signBucketURL is swapped out in tests with a fake signer so SignedStateURL
+// can be exercised without talking to the IAM Credentials API.
+var signBucketURL = func(bucket *storage.BucketHandle, object string, opts *storage.SignedURLOptions) (string, error) {
+	return bucket.SignedURL(object, opts)
+}
+
+// SignedStateURL returns a time-limited V4 signed URL for the state object
+// belonging to workspace (or its lock file, if opts.Lock is set).
+//
+// Deliberately no PrivateKey or GoogleAccessID is passed to bucket.SignedURL:
+// leaving them unset makes the storage client sign the URL via the IAM
+// Credentials API using whatever principal configure() set up (a JSON key,
+// ADC, or an impersonated service account), so no separate private key ever
+// needs to be loaded or shared.
+func (b *Backend) SignedStateURL(workspace string, opts SignedURLOptions) (string, error) {
+	if opts.TTL <= 0 {
+		return "", fmt.Errorf("TTL must be greater than zero")
+	}
+
+	method := opts.Method
+	if method == "" {
+		method = "GET"
+	}
+
+	objectPath := b.stateFile(workspace)
+	if opts.Lock {
+		objectPath = b.lockFile(workspace)
+	}
+
+	bucket := b.storageClient.Bucket(b.bucketName)
+	url, err := signBucketURL(bucket, objectPath, &storage.SignedURLOptions{
+		SigningScheme: storage.SigningSchemeV4,
+		Method:        method,
+		Expires:       time.Now().Add(opts.TTL),
+	})
+	if err != nil {
+		return "", fmt.Errorf("failed to sign URL for %q: %s", objectPath, err)
+	}
+
+	return url, nil
+}
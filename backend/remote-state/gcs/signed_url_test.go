@@ -0,0 +1,133 @@
+package gcs
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"testing"
+	"time"
+
+	"cloud.google.com/go/storage"
+	"github.com/hashicorp/terraform/backend"
+)
+
+func TestSignedStateURL_rejectsNonPositiveTTL(t *testing.T) {
+	b := New().(*Backend)
+	b.bucketName = "terraform-state"
+
+	for _, ttl := range []time.Duration{0, -time.Second} {
+		if _, err := b.SignedStateURL("default", SignedURLOptions{TTL: ttl}); err == nil {
+			t.Fatalf("expected TTL %s to be rejected", ttl)
+		}
+	}
+}
+
+func TestSignedStateURL_fakeSigner(t *testing.T) {
+	var gotObject string
+	var gotOpts *storage.SignedURLOptions
+
+	orig := signBucketURL
+	signBucketURL = func(bucket *storage.BucketHandle, object string, opts *storage.SignedURLOptions) (string, error) {
+		gotObject = object
+		gotOpts = opts
+		return "https://storage.googleapis.com/fake-signed-url", nil
+	}
+	defer func() { signBucketURL = orig }()
+
+	b := New().(*Backend)
+	b.bucketName = "terraform-state"
+	b.prefix = "env/"
+
+	url, err := b.SignedStateURL("default", SignedURLOptions{TTL: 5 * time.Minute})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if url != "https://storage.googleapis.com/fake-signed-url" {
+		t.Fatalf("unexpected url: %s", url)
+	}
+	if gotObject != "env/default.tfstate" {
+		t.Fatalf("expected the default workspace's state object, got %q", gotObject)
+	}
+	if gotOpts.Method != "GET" {
+		t.Fatalf("expected GET to be the default method, got %q", gotOpts.Method)
+	}
+	if gotOpts.SigningScheme != storage.SigningSchemeV4 {
+		t.Fatal("expected the V4 signing scheme")
+	}
+	if gotOpts.PrivateKey != nil || gotOpts.GoogleAccessID != "" {
+		t.Fatal("expected no private key or access ID so signing falls back to the IAM Credentials API")
+	}
+}
+
+func TestSignedStateURL_lockFile(t *testing.T) {
+	var gotObject string
+
+	orig := signBucketURL
+	signBucketURL = func(bucket *storage.BucketHandle, object string, opts *storage.SignedURLOptions) (string, error) {
+		gotObject = object
+		return "https://storage.googleapis.com/fake-signed-url", nil
+	}
+	defer func() { signBucketURL = orig }()
+
+	b := New().(*Backend)
+	b.bucketName = "terraform-state"
+
+	if _, err := b.SignedStateURL("default", SignedURLOptions{TTL: time.Minute, Lock: true}); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if gotObject != "default.tfstate.tflock" {
+		t.Fatalf("expected the lock object, got %q", gotObject)
+	}
+}
+
+// TestAccSignedStateURL signs and then fetches the state over HTTP using a
+// real bucket, proving the IAM Credentials API fallback actually works end
+// to end.
+func TestAccSignedStateURL(t *testing.T) {
+	testACC(t)
+
+	bucket := os.Getenv("GOOGLE_STATE_BUCKET")
+	if bucket == "" {
+		t.Skip("GOOGLE_STATE_BUCKET must be set for this acceptance test")
+	}
+
+	b := backend.TestBackendConfig(t, New(), map[string]interface{}{
+		"bucket": bucket,
+		"prefix": fmt.Sprintf("terraform-acc-signed-url-%d", time.Now().UnixNano()),
+	}).(*Backend)
+
+	s, err := b.State(DefaultStateName)
+	if err != nil {
+		t.Fatalf("State: %s", err)
+	}
+	if err := s.RefreshState(); err != nil {
+		t.Fatalf("RefreshState: %s", err)
+	}
+	if err := s.PersistState(); err != nil {
+		t.Fatalf("PersistState: %s", err)
+	}
+
+	url, err := b.SignedStateURL(DefaultStateName, SignedURLOptions{TTL: 5 * time.Minute})
+	if err != nil {
+		t.Fatalf("SignedStateURL: %s", err)
+	}
+
+	resp, err := http.Get(url)
+	if err != nil {
+		t.Fatalf("GET signed URL: %s", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		body, _ := ioutil.ReadAll(resp.Body)
+		t.Fatalf("expected 200 fetching signed URL, got %d: %s", resp.StatusCode, body)
+	}
+
+	c, err := b.client(DefaultStateName)
+	if err != nil {
+		t.Fatalf("client: %s", err)
+	}
+	if err := c.Delete(); err != nil {
+		t.Fatalf("Delete: %s", err)
+	}
+}
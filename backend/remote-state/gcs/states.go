@@ -0,0 +1,144 @@
+package gcs
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"cloud.google.com/go/storage"
+	"github.com/hashicorp/terraform/state"
+	"github.com/hashicorp/terraform/state/remote"
+	"google.golang.org/api/iterator"
+)
+
+// DefaultStateName is the name of the default, unnamed state that every
+// backend must support.
+const DefaultStateName = "default"
+
+const (
+	stateFileSuffix = ".tfstate"
+	lockFileSuffix  = ".tflock"
+)
+
+func (b *Backend) States() ([]string, error) {
+	states := []string{DefaultStateName}
+
+	it := b.storageClient.Bucket(b.bucketName).Objects(b.storageContext, &storage.Query{Prefix: b.prefix})
+	for {
+		objAttrs, err := it.Next()
+		if err == iterator.Done {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		name := strings.TrimPrefix(objAttrs.Name, b.prefix)
+		if !strings.HasSuffix(name, stateFileSuffix) {
+			continue
+		}
+		name = strings.TrimSuffix(name, stateFileSuffix)
+		if name == "" || name == DefaultStateName {
+			continue
+		}
+
+		states = append(states, name)
+	}
+
+	sort.Strings(states[1:])
+	return states, nil
+}
+
+func (b *Backend) DeleteState(name string) error {
+	if name == DefaultStateName || name == "" {
+		return fmt.Errorf("cowardly refusing to delete the default state")
+	}
+
+	c, err := b.client(name)
+	if err != nil {
+		return err
+	}
+
+	return c.Delete()
+}
+
+func (b *Backend) State(name string) (state.State, error) {
+	c, err := b.client(name)
+	if err != nil {
+		return nil, err
+	}
+
+	stateMgr := &remote.State{Client: c}
+
+	// Grab a lock, this may be the first time the state file is being
+	// created, in which case we want to release the lock when we're done
+	// here and let the caller lock it again when it's actually modified.
+	lockInfo := state.NewLockInfo()
+	lockInfo.Operation = "init"
+	lockID, err := stateMgr.Lock(lockInfo)
+	if err != nil {
+		return nil, fmt.Errorf("failed to lock GCS state: %s", err)
+	}
+
+	lockUnlock := func(parent error) error {
+		if err := stateMgr.Unlock(lockID); err != nil {
+			const unlockErrMsg = `%v
+
+Additionally, unlocking the state in GCS failed:
+
+Error message: %q
+Lock ID (gen): %v
+
+You may have to force-unlock this state in order to use it again.`
+			return fmt.Errorf(unlockErrMsg, parent, err.Error(), lockID)
+		}
+
+		return parent
+	}
+
+	if err := stateMgr.RefreshState(); err != nil {
+		return nil, lockUnlock(err)
+	}
+
+	// If we have no state, we have to create an empty state.
+	if v := stateMgr.State(); v == nil {
+		if err := stateMgr.WriteState(state.NewState()); err != nil {
+			return nil, lockUnlock(err)
+		}
+		if err := stateMgr.PersistState(); err != nil {
+			return nil, lockUnlock(err)
+		}
+	}
+
+	if err := lockUnlock(nil); err != nil {
+		return nil, err
+	}
+
+	return stateMgr, nil
+}
+
+func (b *Backend) client(name string) (*remoteClient, error) {
+	if strings.Contains(name, "/") {
+		return nil, fmt.Errorf("workspace names must not contain slashes")
+	}
+
+	return &remoteClient{
+		storageContext: b.storageContext,
+		storageClient:  b.storageClient,
+		bucket:         b.bucketName,
+		stateFilePath:  b.stateFile(name),
+		lockFilePath:   b.lockFile(name),
+		encryptionKey:  b.encryptionKey,
+		kmsKeyName:     b.kmsKeyName,
+		lockingMode:    b.lockingMode,
+		lockTimeout:    b.lockTimeout,
+	}, nil
+}
+
+func (b *Backend) stateFile(name string) string {
+	return b.prefix + name + stateFileSuffix
+}
+
+func (b *Backend) lockFile(name string) string {
+	return b.stateFile(name) + lockFileSuffix
+}